@@ -0,0 +1,247 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Michael Gibson (michael.gibson79@gmail.com)
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package geoip2
+
+import (
+        "fmt"
+        "github.com/hashicorp/golang-lru"
+        "github.com/oschwald/geoip2-golang"
+        "github.com/oschwald/maxminddb-golang"
+        "net"
+        "sync"
+        "time"
+)
+
+// Record is the result of a GeoBackend lookup. Exactly one of the typed
+// fields is populated when the backend knows it is reading a standard
+// MaxMind edition; Raw carries the fully-generic decode and is what
+// maxminddbBackend fills in for custom (non-MaxMind) schemas.
+type Record struct {
+        City           *geoip2.City
+        ISP            *geoip2.ISP
+        ASN            *geoip2.ASN
+        AnonymousIP    *geoip2.AnonymousIP
+        ConnectionType *geoip2.ConnectionType
+        Network        *net.IPNet
+        Raw            map[string]interface{}
+}
+
+// GeoBackend abstracts over where enrichment data for an IP comes from, so
+// GeoIp2Decoder isn't hard-wired to geoip2-golang. It lets operators point
+// a db_* path at a non-MaxMind mmdb schema (IPinfo, db-ip, ...) by reading
+// it generically, or stub out lookups entirely in tests.
+type GeoBackend interface {
+        Lookup(ip net.IP) (*Record, error)
+        Close() error
+}
+
+// geoip2Backend wraps a *geoip2.Reader and dispatches Lookup to whichever
+// typed accessor matches the edition the reader was opened against. The
+// "asn" kind additionally resolves the containing network via a second,
+// raw maxminddb.Reader opened on the same file, since geoip2-golang has no
+// LookupNetwork of its own.
+type geoip2Backend struct {
+        kind   string
+        reader *geoip2.Reader
+        mmdb   *maxminddb.Reader
+}
+
+func newGeoip2Backend(path string, kind string) (*geoip2Backend, error) {
+        reader, err := geoip2.Open(path)
+        if err != nil {
+                return nil, err
+        }
+
+        b := &geoip2Backend{kind: kind, reader: reader}
+
+        if kind == "asn" {
+                if b.mmdb, err = maxminddb.Open(path); err != nil {
+                        reader.Close()
+                        return nil, err
+                }
+        }
+
+        return b, nil
+}
+
+func (b *geoip2Backend) Lookup(ip net.IP) (*Record, error) {
+        switch b.kind {
+        case "city":
+                rec, err := b.reader.City(ip)
+                if err != nil {
+                        return nil, err
+                }
+                return &Record{City: rec}, nil
+        case "isp":
+                rec, err := b.reader.ISP(ip)
+                if err != nil {
+                        return nil, err
+                }
+                return &Record{ISP: rec}, nil
+        case "asn":
+                rec, err := b.reader.ASN(ip)
+                if err != nil {
+                        return nil, err
+                }
+                result := &Record{ASN: rec}
+                if b.mmdb != nil {
+                        var raw geoip2.ASN
+                        if network, ok, nerr := b.mmdb.LookupNetwork(ip, &raw); nerr == nil && ok {
+                                result.Network = network
+                        }
+                }
+                return result, nil
+        case "anonymous_ip":
+                rec, err := b.reader.AnonymousIP(ip)
+                if err != nil {
+                        return nil, err
+                }
+                return &Record{AnonymousIP: rec}, nil
+        case "connection_type":
+                rec, err := b.reader.ConnectionType(ip)
+                if err != nil {
+                        return nil, err
+                }
+                return &Record{ConnectionType: rec}, nil
+        default:
+                return nil, fmt.Errorf("geoip2Backend: unknown kind %q", b.kind)
+        }
+}
+
+func (b *geoip2Backend) Close() error {
+        if b.mmdb != nil {
+                b.mmdb.Close()
+        }
+        return b.reader.Close()
+}
+
+// maxminddbBackend reads an mmdb file with no assumptions about its
+// schema, for operators running the decoder against a non-MaxMind
+// database. The decoded record is exposed only via Record.Raw.
+type maxminddbBackend struct {
+        reader *maxminddb.Reader
+}
+
+func newMaxminddbBackend(path string) (*maxminddbBackend, error) {
+        reader, err := maxminddb.Open(path)
+        if err != nil {
+                return nil, err
+        }
+        return &maxminddbBackend{reader: reader}, nil
+}
+
+func (b *maxminddbBackend) Lookup(ip net.IP) (*Record, error) {
+        var raw map[string]interface{}
+        network, _, err := b.reader.LookupNetwork(ip, &raw)
+        if err != nil {
+                return nil, err
+        }
+        return &Record{Raw: raw, Network: network}, nil
+}
+
+func (b *maxminddbBackend) Close() error {
+        return b.reader.Close()
+}
+
+// memoryBackend is an in-memory GeoBackend keyed by IP string, for tests
+// that need deterministic lookups without a real mmdb file on disk.
+type memoryBackend struct {
+        mu      sync.RWMutex
+        records map[string]*Record
+}
+
+func newMemoryBackend() *memoryBackend {
+        return &memoryBackend{records: make(map[string]*Record)}
+}
+
+// Set registers the record to return for the given IP's Lookup.
+func (b *memoryBackend) Set(ip net.IP, record *Record) {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        b.records[ip.String()] = record
+}
+
+func (b *memoryBackend) Lookup(ip net.IP) (*Record, error) {
+        b.mu.RLock()
+        defer b.mu.RUnlock()
+
+        if record, ok := b.records[ip.String()]; ok {
+                return record, nil
+        }
+        return &Record{}, nil
+}
+
+func (b *memoryBackend) Close() error {
+        return nil
+}
+
+// cacheEntry is what cachingBackend stores in its LRU, including a failed
+// lookup (err != nil), so a lookup that errored isn't retried against the
+// wrapped backend until the entry expires.
+type cacheEntry struct {
+        record  *Record
+        err     error
+        expires time.Time
+}
+
+// cachingBackend wraps another GeoBackend with a size-bounded, TTL-expiring
+// LRU cache keyed by ip.String(), so repeat visitors in high-throughput
+// pipelines don't re-hit the mmap on every pack. Hits, misses and lookup
+// latency feed into a shared lookupStats so GeoIp2Decoder.ReportMsg can expose
+// them through Heka's plugin reporting interface.
+type cachingBackend struct {
+        backend GeoBackend
+        kind    string
+        ttl     time.Duration
+        stats   *lookupStats
+        cache   *lru.Cache
+}
+
+func newCachingBackend(backend GeoBackend, kind string, size int, ttl time.Duration, stats *lookupStats) (*cachingBackend, error) {
+        cache, err := lru.New(size)
+        if err != nil {
+                return nil, err
+        }
+        return &cachingBackend{backend: backend, kind: kind, ttl: ttl, stats: stats, cache: cache}, nil
+}
+
+func (b *cachingBackend) Lookup(ip net.IP) (*Record, error) {
+        key := ip.String()
+
+        if cached, ok := b.cache.Get(key); ok {
+                entry := cached.(*cacheEntry)
+                if time.Now().Before(entry.expires) {
+                        b.stats.recordHit()
+                        return entry.record, entry.err
+                }
+                b.cache.Remove(key)
+        }
+        b.stats.recordMiss()
+
+        start := time.Now()
+        record, err := b.backend.Lookup(ip)
+        b.stats.latency.Record(time.Since(start))
+        if err != nil {
+                b.stats.recordError(b.kind)
+        }
+
+        b.cache.Add(key, &cacheEntry{record: record, err: err, expires: time.Now().Add(b.ttl)})
+        return record, err
+}
+
+func (b *cachingBackend) Close() error {
+        return b.backend.Close()
+}
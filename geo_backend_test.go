@@ -0,0 +1,81 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Michael Gibson (michael.gibson79@gmail.com)
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package geoip2
+
+import (
+        "net"
+        "testing"
+        "time"
+)
+
+// TestCachingBackendHitsAndMisses checks that a repeat Lookup for the same
+// IP is served from the cache (and counted as a hit) instead of going back
+// to the wrapped backend, while a miss passes through and increments the
+// miss counter.
+func TestCachingBackendHitsAndMisses(t *testing.T) {
+        inner := newMemoryBackend()
+        ip := net.ParseIP("203.0.113.1")
+        inner.Set(ip, &Record{Raw: map[string]interface{}{"seen": 1}})
+
+        stats := newLookupStats([]string{"test"})
+        cached, err := newCachingBackend(inner, "test", 10, time.Minute, stats)
+        if err != nil {
+                t.Fatalf("newCachingBackend returned error: %s", err)
+        }
+
+        if _, err := cached.Lookup(ip); err != nil {
+                t.Fatalf("Lookup returned error: %s", err)
+        }
+        if _, err := cached.Lookup(ip); err != nil {
+                t.Fatalf("Lookup returned error: %s", err)
+        }
+
+        if stats.cacheMisses != 1 {
+                t.Errorf("cacheMisses = %d, want 1", stats.cacheMisses)
+        }
+        if stats.cacheHits != 1 {
+                t.Errorf("cacheHits = %d, want 1", stats.cacheHits)
+        }
+}
+
+// TestCachingBackendExpiry checks that an entry older than the configured
+// TTL is treated as a miss and re-fetched from the wrapped backend rather
+// than served stale.
+func TestCachingBackendExpiry(t *testing.T) {
+        inner := newMemoryBackend()
+        ip := net.ParseIP("203.0.113.2")
+        inner.Set(ip, &Record{Raw: map[string]interface{}{"seen": 1}})
+
+        stats := newLookupStats([]string{"test"})
+        cached, err := newCachingBackend(inner, "test", 10, -time.Second, stats)
+        if err != nil {
+                t.Fatalf("newCachingBackend returned error: %s", err)
+        }
+
+        if _, err := cached.Lookup(ip); err != nil {
+                t.Fatalf("Lookup returned error: %s", err)
+        }
+        if _, err := cached.Lookup(ip); err != nil {
+                t.Fatalf("Lookup returned error: %s", err)
+        }
+
+        if stats.cacheMisses != 2 {
+                t.Errorf("cacheMisses = %d, want 2 (TTL already elapsed)", stats.cacheMisses)
+        }
+        if stats.cacheHits != 0 {
+                t.Errorf("cacheHits = %d, want 0", stats.cacheHits)
+        }
+}
@@ -16,29 +16,72 @@
 package geoip2
 
 import (
+        "compress/gzip"
+        "crypto/md5"
+        "encoding/hex"
+        "encoding/json"
         "fmt"
+        "github.com/fsnotify/fsnotify"
+        "github.com/mmcloughlin/geohash"
         "github.com/oschwald/geoip2-golang"
         "github.com/mozilla-services/heka/message"
         . "github.com/mozilla-services/heka/pipeline"
+        "io/ioutil"
         "net"
+        "net/http"
         "bytes"
+        "os"
+        "path/filepath"
+        "runtime"
         "strconv"
+        "strings"
+        "sync"
+        "sync/atomic"
+        "time"
 )
 
+// updateHTTPClient is shared by every updateEdition call. It carries a
+// hard timeout so a hung MaxMind endpoint can't block pollForUpdates (and
+// therefore Stop's bgWg.Wait) indefinitely.
+var updateHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// updateBaseURL is the root of MaxMind's GeoIP Update endpoint. It's a var
+// rather than an inline constant so tests can point updateEdition at a
+// local httptest.Server.
+var updateBaseURL = "https://updates.maxmind.com/geoip/databases"
+
 type GeoIp2Decoder struct {
         AnonDatabaseFile      string
         CityDatabaseFile      string
         ConnDatabaseFile      string
         ISPDatabaseFile       string
+        ASNDatabaseFile       string
+        CustomDatabaseFile    string
+        CustomFields          []string
         SourceAddrFields      []string
         TargetField           string
         Language              string
         JSONObject            bool
         DNSLookup             bool
-        anon_db               *geoip2.Reader
-        city_db               *geoip2.Reader
-        conn_db               *geoip2.Reader
-        isp_db                *geoip2.Reader
+        GeohashPrecision      uint
+        SkipPrivateRanges     bool
+        skipCIDRs             []*net.IPNet
+        onlyCountries         map[string]bool
+        skipCountries         map[string]bool
+        dbLock                sync.RWMutex
+        anonBackend           GeoBackend
+        cityBackend           GeoBackend
+        connBackend           GeoBackend
+        ispBackend            GeoBackend
+        asnBackend            GeoBackend
+        customBackend         GeoBackend
+        watcher               *fsnotify.Watcher
+        stopChan              chan struct{}
+        bgWg                  sync.WaitGroup
+        workerSem             chan struct{}
+        cacheSize             int
+        cacheTTL              time.Duration
+        stats                 *lookupStats
         Config                *GeoIp2DecoderConfig
         pConfig               *PipelineConfig
 }
@@ -48,6 +91,22 @@ type GeoIp2DecoderConfig struct {
         CityDatabaseFile   string   `toml:"db_city"`
         ConnDatabaseFile   string   `toml:"db_conn"`
         ISPDatabaseFile    string   `toml:"db_isp"`
+        ASNDatabaseFile    string   `toml:"db_asn"`
+
+        // Path to an mmdb file with a non-MaxMind schema (e.g. IPinfo,
+        // db-ip), read generically through maxminddb-golang instead of
+        // the geoip2-golang typed accessors. Its decoded record is
+        // exposed as a flat set of "<target_field_prefix>_<key>" fields
+        // (or nested under "custom_fields" to pick specific keys and an
+        // emission order), or as-is in raw_json_object mode.
+        CustomDatabaseFile string   `toml:"db_custom"`
+
+        // If non-empty, only these top-level keys of the db_custom
+        // record are emitted as flat fields, in this order. Defaults to
+        // every scalar top-level key in the decoded record. Ignored in
+        // raw_json_object mode, which emits the whole record.
+        CustomFields       []string `toml:"custom_fields"`
+
         SourceAddrFields   []string `toml:"source_addr_fields"`
         TargetField        string   `toml:"target_field_prefix"`
         Language           string   `toml:"language"`
@@ -64,6 +123,58 @@ type GeoIp2DecoderConfig struct {
         // When false, it will consider the contents
         // of "source_host_field" to be a IP address (default)
         DNSLookup          bool `toml:"dns_lookup"`
+
+        // Precision (in characters) of the geohash computed for city
+        // records that carry a location. Defaults to 9.
+        GeohashPrecision   uint `toml:"geohash_precision"`
+
+        // How often (in seconds) to poll MaxMind's GeoIP Update service for
+        // fresh copies of the configured editions. Zero (the default)
+        // disables auto-update; the databases are still hot-reloaded
+        // whenever they change on disk.
+        RefreshSeconds     uint  `toml:"refresh_seconds"`
+
+        // MaxMind GeoIP Update account credentials, required when
+        // "refresh_seconds" is non-zero.
+        AccountId          string   `toml:"account_id"`
+        LicenseKey         string   `toml:"license_key"`
+
+        // Edition ids to fetch, e.g. "GeoLite2-City", "GeoLite2-ASN".
+        EditionIds         []string `toml:"edition_ids"`
+
+        // Directory the downloaded/unpacked .mmdb files are written into,
+        // as "<edition>.mmdb". A db_* path is reloaded from an update only
+        // when it names that same file.
+        DataDir            string   `toml:"data_dir"`
+
+        // Skip all lookups for addresses in RFC1918/loopback/link-local
+        // ranges, so internal traffic doesn't pay for pointless DB hits.
+        SkipPrivateRanges  bool     `toml:"skip_private_ranges"`
+
+        // Additional CIDRs to bypass lookups for, beyond the private
+        // ranges covered by "skip_private_ranges".
+        SkipCIDRs          []string `toml:"skip_cidrs"`
+
+        // If non-empty, enrichment is only added when the city database's
+        // country ISO code is in this list. Addresses for which the city
+        // database gives no country code are not filtered.
+        OnlyCountries      []string `toml:"only_countries"`
+
+        // Enrichment is omitted when the city database's country ISO code
+        // is in this list.
+        SkipCountries      []string `toml:"skip_countries"`
+
+        // Number of concurrent mmdb lookups a single Decode call may have
+        // in flight at once. Defaults to runtime.NumCPU().
+        Workers            uint  `toml:"workers"`
+
+        // Maximum number of recent IPs to cache per database. Defaults to
+        // 100000.
+        CacheSize          int   `toml:"cache_size"`
+
+        // How long a cached lookup stays valid, in seconds. Defaults to
+        // 600 (10 minutes).
+        CacheTTLSeconds    uint  `toml:"cache_ttl"`
 }
 
 // Heka will call this before calling any other methods to give us access to
@@ -81,6 +192,10 @@ func (gi2 *GeoIp2Decoder) ConfigStruct() interface{} {
                 SourceAddrFields:      safs,
                 TargetField:           "geoip",
                 Language:              "en",
+                GeohashPrecision:      9,
+                Workers:               uint(runtime.NumCPU()),
+                CacheSize:             100000,
+                CacheTTLSeconds:       600,
         }
 }
 
@@ -105,219 +220,636 @@ func (gi2 *GeoIp2Decoder) Init(config interface{}) (err error) {
         gi2.JSONObject         = gi2.Config.JSONObject
         gi2.Language           = gi2.Config.Language
         gi2.TargetField        = gi2.Config.TargetField
+        gi2.GeohashPrecision   = gi2.Config.GeohashPrecision
+        if gi2.GeohashPrecision == 0 {
+                gi2.GeohashPrecision = 9
+        }
+        gi2.SkipPrivateRanges  = gi2.Config.SkipPrivateRanges
+
+        for _, cidr := range gi2.Config.SkipCIDRs {
+                _, network, cerr := net.ParseCIDR(cidr)
+                if cerr != nil {
+                        gi2.LogError(fmt.Errorf("Error: invalid skip_cidrs entry %q: %s", cidr, cerr))
+                        continue
+                }
+                gi2.skipCIDRs = append(gi2.skipCIDRs, network)
+        }
+
+        if len(gi2.Config.OnlyCountries) > 0 {
+                gi2.onlyCountries = make(map[string]bool, len(gi2.Config.OnlyCountries))
+                for _, code := range gi2.Config.OnlyCountries {
+                        gi2.onlyCountries[code] = true
+                }
+        }
+        if len(gi2.Config.SkipCountries) > 0 {
+                gi2.skipCountries = make(map[string]bool, len(gi2.Config.SkipCountries))
+                for _, code := range gi2.Config.SkipCountries {
+                        gi2.skipCountries[code] = true
+                }
+        }
+
+        gi2.AnonDatabaseFile   = gi2.Config.AnonDatabaseFile
+        gi2.CityDatabaseFile   = gi2.Config.CityDatabaseFile
+        gi2.ConnDatabaseFile   = gi2.Config.ConnDatabaseFile
+        gi2.ISPDatabaseFile    = gi2.Config.ISPDatabaseFile
+        gi2.ASNDatabaseFile    = gi2.Config.ASNDatabaseFile
+        gi2.CustomDatabaseFile = gi2.Config.CustomDatabaseFile
+        gi2.CustomFields       = gi2.Config.CustomFields
+
+        workers := gi2.Config.Workers
+        if workers == 0 {
+                workers = uint(runtime.NumCPU())
+        }
+        gi2.workerSem = make(chan struct{}, workers)
+
+        gi2.cacheSize = gi2.Config.CacheSize
+        if gi2.cacheSize == 0 {
+                gi2.cacheSize = 100000
+        }
+        ttlSeconds := gi2.Config.CacheTTLSeconds
+        if ttlSeconds == 0 {
+                ttlSeconds = 600
+        }
+        gi2.cacheTTL = time.Duration(ttlSeconds) * time.Second
+
+        gi2.stats = newLookupStats([]string{"anonymous_ip", "city", "connection_type", "isp", "asn", "custom"})
+
+        if err = gi2.openDatabases(); err != nil {
+                return err
+        }
+
+        gi2.stopChan = make(chan struct{})
+
+        if gi2.watcher, err = fsnotify.NewWatcher(); err != nil {
+                gi2.LogError(fmt.Errorf("Error: Could not start database file watcher: %s", err))
+        } else {
+                for _, path := range []string{gi2.AnonDatabaseFile, gi2.CityDatabaseFile, gi2.ConnDatabaseFile, gi2.ISPDatabaseFile, gi2.ASNDatabaseFile, gi2.CustomDatabaseFile} {
+                        if path == "" {
+                                continue
+                        }
+                        if err := gi2.watcher.Add(filepath.Dir(path)); err != nil {
+                                gi2.LogError(fmt.Errorf("Error: Could not watch %s: %s", path, err))
+                        }
+                }
+                gi2.bgWg.Add(1)
+                go func() {
+                        defer gi2.bgWg.Done()
+                        gi2.watchDatabases()
+                }()
+        }
+
+        if gi2.Config.RefreshSeconds > 0 {
+                gi2.bgWg.Add(1)
+                go func() {
+                        defer gi2.bgWg.Done()
+                        gi2.pollForUpdates()
+                }()
+        }
+
+        return
+}
+
+// newRawBackend opens path as the GeoBackend matching kind: the typed
+// geoip2-golang reader for the five standard MaxMind editions, or a raw
+// maxminddbBackend for "custom", which makes no assumption about the
+// mmdb's schema.
+func newRawBackend(path string, kind string) (GeoBackend, error) {
+        if kind == "custom" {
+                return newMaxminddbBackend(path)
+        }
+        return newGeoip2Backend(path, kind)
+}
+
+// openDatabases (re)opens any of the six configured mmdb files that are
+// not already open, as the matching GeoBackend. It is safe to call
+// repeatedly; existing backends are left untouched.
+func (gi2 *GeoIp2Decoder) openDatabases() (err error) {
+        for _, db := range []struct {
+                path string
+                kind string
+                name string
+                slot *GeoBackend
+        }{
+                {gi2.AnonDatabaseFile, "anonymous_ip", "GeoIP2-Anonymous-IP", &gi2.anonBackend},
+                {gi2.CityDatabaseFile, "city", "GeoIP2-City", &gi2.cityBackend},
+                {gi2.ConnDatabaseFile, "connection_type", "GeoIP2-Connection-Type", &gi2.connBackend},
+                {gi2.ISPDatabaseFile, "isp", "GeoIP2-ISP", &gi2.ispBackend},
+                {gi2.ASNDatabaseFile, "asn", "GeoLite2-ASN", &gi2.asnBackend},
+                {gi2.CustomDatabaseFile, "custom", "custom", &gi2.customBackend},
+        } {
+                if *db.slot != nil || db.path == "" {
+                        continue
+                }
+                backend, berr := newRawBackend(db.path, db.kind)
+                if berr != nil {
+                        gi2.LogError(fmt.Errorf("Error: Could not open %s database: %s, skipping\n", db.name, db.path))
+                        continue
+                }
+                cached, cerr := newCachingBackend(backend, db.kind, gi2.cacheSize, gi2.cacheTTL, gi2.stats)
+                if cerr != nil {
+                        gi2.LogError(fmt.Errorf("Error: Could not create cache for %s database: %s, skipping\n", db.name, cerr))
+                        backend.Close()
+                        continue
+                }
+                *db.slot = cached
+        }
+
+        return nil
+}
+
+// watchDatabases runs for the lifetime of the decoder, reopening whichever
+// database just changed on disk. Editors and `mv`-based deploys emit
+// Write/Create/Rename events; any of them triggers a reopen of the reader
+// for that path.
+func (gi2 *GeoIp2Decoder) watchDatabases() {
+        for {
+                select {
+                case event, ok := <-gi2.watcher.Events:
+                        if !ok {
+                                return
+                        }
+                        if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+                                continue
+                        }
+                        gi2.reopenDatabase(event.Name)
+                case err, ok := <-gi2.watcher.Errors:
+                        if !ok {
+                                return
+                        }
+                        gi2.LogError(fmt.Errorf("database watcher error: %s", err))
+                case <-gi2.stopChan:
+                        return
+                }
+        }
+}
+
+// reopenDatabase swaps in a fresh GeoBackend for whichever configured
+// database lives at path, closing the old backend only once the new one
+// is in place and the write lock has been released.
+func (gi2 *GeoIp2Decoder) reopenDatabase(path string) {
+        var slot *GeoBackend
+        var kind string
+        switch path {
+        case gi2.AnonDatabaseFile:
+                slot, kind = &gi2.anonBackend, "anonymous_ip"
+        case gi2.CityDatabaseFile:
+                slot, kind = &gi2.cityBackend, "city"
+        case gi2.ConnDatabaseFile:
+                slot, kind = &gi2.connBackend, "connection_type"
+        case gi2.ISPDatabaseFile:
+                slot, kind = &gi2.ispBackend, "isp"
+        case gi2.ASNDatabaseFile:
+                slot, kind = &gi2.asnBackend, "asn"
+        case gi2.CustomDatabaseFile:
+                slot, kind = &gi2.customBackend, "custom"
+        default:
+                return
+        }
+
+        newBackend, err := newRawBackend(path, kind)
+        if err != nil {
+                gi2.LogError(fmt.Errorf("Error: Could not reopen %s after change: %s", path, err))
+                return
+        }
+        cached, err := newCachingBackend(newBackend, kind, gi2.cacheSize, gi2.cacheTTL, gi2.stats)
+        if err != nil {
+                gi2.LogError(fmt.Errorf("Error: Could not create cache for %s after change: %s", path, err))
+                newBackend.Close()
+                return
+        }
+
+        gi2.dbLock.Lock()
+        oldBackend := *slot
+        *slot = cached
+        gi2.dbLock.Unlock()
+
+        if oldBackend != nil {
+                oldBackend.Close()
+        }
+}
+
+// pollForUpdates polls MaxMind's GeoIP Update service every
+// "refresh_seconds" for each configured edition, downloading a fresh
+// .mmdb.gz, verifying its checksum and swapping it into place on success.
+func (gi2 *GeoIp2Decoder) pollForUpdates() {
+        ticker := time.NewTicker(time.Duration(gi2.Config.RefreshSeconds) * time.Second)
+        defer ticker.Stop()
+
+        for {
+                select {
+                case <-ticker.C:
+                        for _, edition := range gi2.Config.EditionIds {
+                                if err := gi2.updateEdition(edition); err != nil {
+                                        gi2.LogError(fmt.Errorf("Error: MaxMind update of %s failed: %s", edition, err))
+                                }
+                        }
+                case <-gi2.stopChan:
+                        return
+                }
+        }
+}
+
+// updateEdition downloads the latest .mmdb.gz for edition from MaxMind's
+// GeoIP Update endpoint, verifies its MD5 against the X-Database-MD5
+// header MaxMind serves alongside it, and only then atomically renames
+// the decompressed database into gi2.Config.DataDir/<edition>.mmdb. It
+// then calls reopenDatabase on that path, which swaps in a new reader only
+// if the path is one of the configured db_* paths.
+// A response that is missing the header, or whose content doesn't match
+// it, is rejected before anything is written to disk.
+func (gi2 *GeoIp2Decoder) updateEdition(edition string) error {
+        url := fmt.Sprintf("%s/%s/update?db_md5=", updateBaseURL, edition)
 
-        if gi2.anon_db == nil && gi2.Config.AnonDatabaseFile != "" {
-                gi2.anon_db, err = geoip2.Open(gi2.Config.AnonDatabaseFile)
+        req, err := http.NewRequest("GET", url, nil)
+        if err != nil {
+                return err
         }
+        req.SetBasicAuth(gi2.Config.AccountId, gi2.Config.LicenseKey)
+
+        resp, err := updateHTTPClient.Do(req)
         if err != nil {
-                gi2.LogError(fmt.Errorf("Error: Could not open GeoIP2-Anonymous-IP database: %s, skipping\n", gi2.Config.AnonDatabaseFile))
+                return err
+        }
+        defer resp.Body.Close()
+
+        if resp.StatusCode != http.StatusOK {
+                return fmt.Errorf("unexpected status %d from MaxMind update service", resp.StatusCode)
         }
-        if gi2.city_db == nil && gi2.Config.CityDatabaseFile != "" {
-                gi2.city_db, err = geoip2.Open(gi2.Config.CityDatabaseFile)
+
+        wantMD5 := resp.Header.Get("X-Database-MD5")
+        if wantMD5 == "" {
+                return fmt.Errorf("MaxMind response for %s is missing an X-Database-MD5 header, refusing to apply it", edition)
         }
+
+        body, err := ioutil.ReadAll(resp.Body)
         if err != nil {
-                gi2.LogError(fmt.Errorf("Error: Could not open GeoIP2-City database: %s, skipping\n", gi2.Config.CityDatabaseFile))
+                return err
         }
-        if gi2.conn_db == nil && gi2.Config.ConnDatabaseFile != "" {
-                gi2.conn_db, err = geoip2.Open(gi2.Config.ConnDatabaseFile)
+
+        gzr, err := gzip.NewReader(bytes.NewReader(body))
+        if err != nil {
+                return fmt.Errorf("invalid gzip payload: %s", err)
         }
+        defer gzr.Close()
+
+        decompressed, err := ioutil.ReadAll(gzr)
         if err != nil {
-                gi2.LogError(fmt.Errorf("Error: Could not open GeoIP2-Connection-Type database: %s, skipping\n", gi2.Config.ConnDatabaseFile))
+                return fmt.Errorf("invalid gzip payload: %s", err)
         }
-        if gi2.isp_db == nil && gi2.Config.ISPDatabaseFile != "" {
-                gi2.isp_db, err = geoip2.Open(gi2.Config.ISPDatabaseFile)
+
+        sum := md5.Sum(decompressed)
+        gotMD5 := hex.EncodeToString(sum[:])
+        if !strings.EqualFold(gotMD5, wantMD5) {
+                return fmt.Errorf("checksum mismatch for %s: got %s, want %s", edition, gotMD5, wantMD5)
         }
+
+        tmpPath := filepath.Join(gi2.Config.DataDir, edition+".mmdb.tmp")
+        tmp, err := os.Create(tmpPath)
         if err != nil {
-                gi2.LogError(fmt.Errorf("Error: Could not open GeoIP2-ISP database: %s, skipping\n", gi2.Config.ISPDatabaseFile))
+                return err
         }
 
-        return
+        if _, err = tmp.Write(decompressed); err != nil {
+                tmp.Close()
+                os.Remove(tmpPath)
+                return err
+        }
+        if err = tmp.Close(); err != nil {
+                os.Remove(tmpPath)
+                return err
+        }
+
+        finalPath := filepath.Join(gi2.Config.DataDir, edition+".mmdb")
+        if err = os.Rename(tmpPath, finalPath); err != nil {
+                os.Remove(tmpPath)
+                return err
+        }
+
+        gi2.reopenDatabase(finalPath)
+
+        return nil
+}
+
+// cityDoc is the JSON shape written to the target field in raw_json_object
+// mode for city records, and the source of truth for the flat-field names
+// used otherwise.
+type cityDoc struct {
+        Location       [2]float64 `json:"location"`
+        CountryCode    string     `json:"country_code,omitempty"`
+        Country        string     `json:"country,omitempty"`
+        City           string     `json:"city,omitempty"`
+        Geohash        string     `json:"geohash,omitempty"`
+        CountryIsEU    bool       `json:"country_is_eu"`
+        RegionCode     string     `json:"region_code,omitempty"`
+        Region         string     `json:"region,omitempty"`
+        PostalCode     string     `json:"postal_code,omitempty"`
+        AccuracyRadius uint16     `json:"accuracy_radius,omitempty"`
+        TimeZone       string     `json:"time_zone,omitempty"`
 }
 
+type ispDoc struct {
+        ASNumber     uint   `json:"asnum,omitempty"`
+        ASName       string `json:"asname,omitempty"`
+        ISP          string `json:"isp,omitempty"`
+        Organization string `json:"organization,omitempty"`
+}
+
+// asnDoc is the JSON shape for GeoLite2-ASN records, emitted for both the
+// flat-field and raw_json_object output modes.
+type asnDoc struct {
+        ASNNumber       uint   `json:"asn_number,omitempty"`
+        ASNOrganization string `json:"asn_organization,omitempty"`
+        SourceRange     string `json:"source_range,omitempty"`
+}
+
+type anonymousIPDoc struct {
+        AnonymousIP     bool `json:"anonymous_ip,omitempty"`
+        AnonymousVPN    bool `json:"anonymous_vpn,omitempty"`
+        HostingProvider bool `json:"hosting_provider,omitempty"`
+        PublicProxy     bool `json:"public_proxy,omitempty"`
+        TorExitNode     bool `json:"tor_exit_node,omitempty"`
+}
+
+type connectionTypeDoc struct {
+        ConnectionType string `json:"connection_type,omitempty"`
+}
+
+// jsonObjectFields accumulates the per-kind docs produced by a single
+// Decode call in raw_json_object mode, keyed by backend kind ("city",
+// "isp", "asn", "anonymous_ip", "connection_type", "custom"). Decode
+// marshals this once per pack so that matching more than one backend
+// (e.g. city + asn) produces one merged gi2.TargetField instead of
+// several fields that all share its name.
+type jsonObjectFields map[string]interface{}
+
 //Creates new Heka Message fields for the following location info
 //(if they are contained in the record): location coordinates,
 //country ISO code, country name in English, city name in English
-func (gi2 *GeoIp2Decoder) CreateMessageFieldsCity(record *geoip2.City, pack *PipelinePack) (err error) {
-        countrycode := record.Country.IsoCode
-        country     := record.Country.Names[gi2.Language]
-        city        := record.City.Names[gi2.Language]
+func (gi2 *GeoIp2Decoder) CreateMessageFieldsCity(record *geoip2.City, pack *PipelinePack, jsonFields jsonObjectFields) (err error) {
+        doc := cityDoc{
+                Location:    [2]float64{record.Location.Longitude, record.Location.Latitude},
+                CountryCode: record.Country.IsoCode,
+                Country:     record.Country.Names[gi2.Language],
+                City:        record.City.Names[gi2.Language],
+                CountryIsEU: record.Country.IsInEuropeanUnion,
+                PostalCode:  record.Postal.Code,
+                AccuracyRadius: record.Location.AccuracyRadius,
+                TimeZone:    record.Location.TimeZone,
+        }
+
+        if len(record.Subdivisions) > 0 {
+                doc.RegionCode = record.Subdivisions[0].IsoCode
+                doc.Region = record.Subdivisions[0].Names[gi2.Language]
+        }
+        if record.Location.Latitude != 0.0 || record.Location.Longitude != 0.0 {
+                doc.Geohash = geohash.EncodeWithPrecision(record.Location.Latitude, record.Location.Longitude, gi2.GeohashPrecision)
+        }
 
         lat := strconv.FormatFloat(record.Location.Latitude,'g', 16, 32)
         lon := strconv.FormatFloat(record.Location.Longitude,'g', 16, 32)
 
         if gi2.JSONObject {
-                buf := bytes.Buffer{}
-                buf.WriteString(`{`)
-
-                buf.WriteString(`"location":[`)
-                buf.WriteString(lon)
-                buf.WriteString(`,`)
-                buf.WriteString(lat)
-                buf.WriteString(`]`)
+                jsonFields["city"] = doc
+        } else {
+                gi2.AddField(pack, fmt.Sprintf("%s_location",gi2.TargetField), fmt.Sprintf("%s, %s", lat, lon))
 
-                if countrycode != "" {
-                        buf.WriteString(`,"country_code":"`)
-                        buf.WriteString(countrycode)
-                        buf.WriteString(`"`)
+                if doc.CountryCode != "" {
+                        gi2.AddField(pack, fmt.Sprintf("%s_country_code",gi2.TargetField), doc.CountryCode)
                 }
-                if country != "" {
-                        buf.WriteString(`,"country":"`)
-                        buf.WriteString(country)
-                        buf.WriteString(`"`)
+                if doc.Country != "" {
+                        gi2.AddField(pack, fmt.Sprintf("%s_country",gi2.TargetField), doc.Country)
                 }
-                if city != "" {
-                        buf.WriteString(`,"city":"`)
-                        buf.WriteString(city)
-                        buf.WriteString(`"`)
+                if doc.City != "" {
+                        gi2.AddField(pack, fmt.Sprintf("%s_city",gi2.TargetField), doc.City)
                 }
-
-                buf.WriteString(`}`)
-
-                gi2.AddField(pack, gi2.TargetField, buf.Bytes())
-        } else {
-                gi2.AddField(pack, fmt.Sprintf("%s_location",gi2.TargetField), fmt.Sprintf("%s, %s", lat, lon))
-
-                if countrycode != "" {
-                        gi2.AddField(pack, fmt.Sprintf("%s_country_code",gi2.TargetField), countrycode)
+                if doc.Geohash != "" {
+                        gi2.AddField(pack, fmt.Sprintf("%s_geohash",gi2.TargetField), doc.Geohash)
+                }
+                gi2.AddField(pack, fmt.Sprintf("%s_country_is_eu",gi2.TargetField), doc.CountryIsEU)
+                if doc.RegionCode != "" {
+                        gi2.AddField(pack, fmt.Sprintf("%s_region_code",gi2.TargetField), doc.RegionCode)
+                }
+                if doc.Region != "" {
+                        gi2.AddField(pack, fmt.Sprintf("%s_region",gi2.TargetField), doc.Region)
+                }
+                if doc.PostalCode != "" {
+                        gi2.AddField(pack, fmt.Sprintf("%s_postal_code",gi2.TargetField), doc.PostalCode)
                 }
-                if country != "" {
-                        gi2.AddField(pack, fmt.Sprintf("%s_country",gi2.TargetField), country)
+                if doc.AccuracyRadius != 0 {
+                        gi2.AddField(pack, fmt.Sprintf("%s_accuracy_radius",gi2.TargetField), gi2.GetData(doc.AccuracyRadius))
                 }
-                if city != "" {
-                        gi2.AddField(pack, fmt.Sprintf("%s_city",gi2.TargetField), city)
+                if doc.TimeZone != "" {
+                        gi2.AddField(pack, fmt.Sprintf("%s_time_zone",gi2.TargetField), doc.TimeZone)
                 }
         }
 
         return
 }
 
-func (gi2 *GeoIp2Decoder) CreateMessageFieldsISP(record *geoip2.ISP, pack *PipelinePack) (err error) {
-        asnum          := record.AutonomousSystemNumber
-        asname         := record.AutonomousSystemOrganization
-        isp            := record.ISP
-        organization   := record.Organization
+func (gi2 *GeoIp2Decoder) CreateMessageFieldsISP(record *geoip2.ISP, pack *PipelinePack, jsonFields jsonObjectFields) (err error) {
+        doc := ispDoc{
+                ASNumber:     uint(record.AutonomousSystemNumber),
+                ASName:       record.AutonomousSystemOrganization,
+                ISP:          record.ISP,
+                Organization: record.Organization,
+        }
 
         if gi2.JSONObject {
-                buf := bytes.Buffer{}
-                buf.WriteString(`{`)
-
-                if asnum != 0 {
-                        buf.WriteString(`"asnum":`)
-                        buf.WriteString(strconv.FormatUint(uint64(asnum), 10))
+                jsonFields["isp"] = doc
+        } else {
+                if doc.ASNumber != 0 {
+                        gi2.AddField(pack, fmt.Sprintf("asnum"), gi2.GetData(doc.ASNumber))
                 }
-                if asname != "" {
-                        buf.WriteString(`,"asname":"`)
-                        buf.WriteString(asname)
-                        buf.WriteString(`"`)
+                if doc.ASName != "" {
+                        gi2.AddField(pack, fmt.Sprintf("asname"), doc.ASName)
                 }
-                if isp != "" {
-                        buf.WriteString(`,"isp":"`)
-                        buf.WriteString(isp)
-                        buf.WriteString(`"`)
+                if doc.ISP != "" {
+                        gi2.AddField(pack, fmt.Sprintf("isp"), doc.ISP)
                 }
-                if organization != "" {
-                        buf.WriteString(`,"organization":"`)
-                        buf.WriteString(organization)
-                        buf.WriteString(`"`)
+                if doc.Organization != "" {
+                        gi2.AddField(pack, fmt.Sprintf("organization"), doc.Organization)
                 }
+        }
 
-                buf.WriteString(`}`)
+        return
+}
 
-                gi2.AddField(pack, gi2.TargetField, buf.Bytes())
+// CreateMessageFieldsASN emits the autonomous system info carried by a
+// GeoLite2-ASN record, plus the CIDR of the network the looked-up address
+// falls in, as reported by a maxminddb.Reader.LookupNetwork call against
+// the same file.
+func (gi2 *GeoIp2Decoder) CreateMessageFieldsASN(record *geoip2.ASN, sourceRange *net.IPNet, pack *PipelinePack, jsonFields jsonObjectFields) (err error) {
+        doc := asnDoc{
+                ASNNumber:       uint(record.AutonomousSystemNumber),
+                ASNOrganization: record.AutonomousSystemOrganization,
+        }
+        if sourceRange != nil {
+                doc.SourceRange = sourceRange.String()
+        }
 
+        if gi2.JSONObject {
+                jsonFields["asn"] = doc
         } else {
-                if asnum != 0 {
-                        gi2.AddField(pack, fmt.Sprintf("asnum"), gi2.GetData(asnum))
+                if doc.ASNNumber != 0 {
+                        gi2.AddField(pack, fmt.Sprintf("asn_number"), gi2.GetData(doc.ASNNumber))
                 }
-                if asname != "" {
-                        gi2.AddField(pack, fmt.Sprintf("asname"), asname)
+                if doc.ASNOrganization != "" {
+                        gi2.AddField(pack, fmt.Sprintf("asn_organization"), doc.ASNOrganization)
                 }
-                if isp != "" {
-                        gi2.AddField(pack, fmt.Sprintf("isp"), isp)
-                }
-                if organization != "" {
-                        gi2.AddField(pack, fmt.Sprintf("organization"), organization)
+                if doc.SourceRange != "" {
+                        gi2.AddField(pack, fmt.Sprintf("source_range"), doc.SourceRange)
                 }
         }
 
         return
 }
 
-func (gi2 *GeoIp2Decoder) CreateMessageFieldsAnonymousIP(record *geoip2.AnonymousIP, pack *PipelinePack) (err error) {
-        anon        := record.IsAnonymous
-        anonvpn     := record.IsAnonymousVPN
-        hostingpro  := record.IsHostingProvider
-        publicproxy := record.IsPublicProxy
-        torexitnode := record.IsTorExitNode
+func (gi2 *GeoIp2Decoder) CreateMessageFieldsAnonymousIP(record *geoip2.AnonymousIP, pack *PipelinePack, jsonFields jsonObjectFields) (err error) {
+        doc := anonymousIPDoc{
+                AnonymousIP:     record.IsAnonymous,
+                AnonymousVPN:    record.IsAnonymousVPN,
+                HostingProvider: record.IsHostingProvider,
+                PublicProxy:     record.IsPublicProxy,
+                TorExitNode:     record.IsTorExitNode,
+        }
 
         if gi2.JSONObject {
-                buf := bytes.Buffer{}
-                buf.WriteString(`{`)
-
-                if anon {
-                        buf.WriteString(`,"anonymous_ip": true,`)
+                jsonFields["anonymous_ip"] = doc
+        } else {
+                if doc.AnonymousIP {
+                        gi2.AddField(pack, fmt.Sprintf("anonymous_ip"), doc.AnonymousIP)
                 }
-                if anonvpn {
-                        buf.WriteString(`,"anonymous_vpn": true`)
+                if doc.AnonymousVPN {
+                        gi2.AddField(pack, fmt.Sprintf("anonymous_vpn"), doc.AnonymousVPN)
                 }
-                if hostingpro {
-                        buf.WriteString(`,"hosting_provider": true`)
+                if doc.HostingProvider {
+                        gi2.AddField(pack, fmt.Sprintf("hosting_provider"), doc.HostingProvider)
                 }
-                if publicproxy {
-                        buf.WriteString(`,"public_proxy": true`)
+                if doc.PublicProxy {
+                        gi2.AddField(pack, fmt.Sprintf("public_proxy"), doc.PublicProxy)
                 }
-                if torexitnode {
-                        buf.WriteString(`,"tor_exit_node": true`)
+                if doc.TorExitNode {
+                        gi2.AddField(pack, fmt.Sprintf("tor_exit_node"), doc.TorExitNode)
                 }
+        }
 
-                buf.WriteString(`}`)
+        return
+}
 
-                gi2.AddField(pack, gi2.TargetField, buf.Bytes())
+func (gi2 *GeoIp2Decoder) CreateMessageFieldsConnectionType(record *geoip2.ConnectionType, pack *PipelinePack, jsonFields jsonObjectFields) (err error) {
+        doc := connectionTypeDoc{ConnectionType: record.ConnectionType}
 
+        if gi2.JSONObject {
+                jsonFields["connection_type"] = doc
         } else {
-                if anon {
-                        gi2.AddField(pack, fmt.Sprintf("anonymous_ip"), anon)
-                }
-                if anonvpn {
-                        gi2.AddField(pack, fmt.Sprintf("anonymous_vpn"), anonvpn)
-                }
-                if hostingpro {
-                        gi2.AddField(pack, fmt.Sprintf("hosting_provider"), hostingpro)
-                }
-                if publicproxy {
-                        gi2.AddField(pack, fmt.Sprintf("public_proxy"), publicproxy)
-                }
-                if torexitnode {
-                        gi2.AddField(pack, fmt.Sprintf("tor_exit_node"), torexitnode)
+                if doc.ConnectionType != "" {
+                        gi2.AddField(pack, fmt.Sprintf("connection_type"), doc.ConnectionType)
                 }
         }
 
         return
 }
 
-func (gi2 *GeoIp2Decoder) CreateMessageFieldsConnectionType(record *geoip2.ConnectionType, pack *PipelinePack) (err error) {
-        conntype := record.ConnectionType
-
+// CreateMessageFieldsRaw emits the generically-decoded record read from
+// db_custom, for mmdb schemas geoip2-golang doesn't know about. In
+// raw_json_object mode the whole map is merged into jsonFields under the
+// "custom" key; otherwise only the scalar top-level keys named by
+// gi2.CustomFields (or, if empty, every scalar top-level key) are emitted
+// as "<target_field_prefix>_<key>" fields. Nested maps/slices aren't flat
+// Heka field values, so they're skipped rather than guessed at.
+func (gi2 *GeoIp2Decoder) CreateMessageFieldsRaw(raw map[string]interface{}, pack *PipelinePack, jsonFields jsonObjectFields) (err error) {
         if gi2.JSONObject {
-                buf := bytes.Buffer{}
-                buf.WriteString(`{`)
+                jsonFields["custom"] = raw
+                return nil
+        }
 
-                if conntype != "" {
-                        buf.WriteString(`"connection_type":"`)
-                        buf.WriteString(conntype)
-                        buf.WriteString(`"`)
+        keys := gi2.CustomFields
+        if len(keys) == 0 {
+                for key := range raw {
+                        keys = append(keys, key)
                 }
+        }
 
-                buf.WriteString(`}`)
+        for _, key := range keys {
+                value, ok := raw[key]
+                if !ok {
+                        continue
+                }
+                switch value.(type) {
+                case string, bool,
+                        int, int8, int16, int32, int64,
+                        uint, uint8, uint16, uint32, uint64,
+                        float32, float64:
+                        gi2.AddField(pack, fmt.Sprintf("%s_%s", gi2.TargetField, key), gi2.GetData(value))
+                }
+        }
 
-                gi2.AddField(pack, gi2.TargetField, buf.Bytes())
+        return nil
+}
 
-        } else {
-                if conntype != "" {
-                        gi2.AddField(pack, fmt.Sprintf("connection_type"), conntype)
+// skipLookup reports whether ip should bypass all database lookups,
+// either because it falls in a well-known private range (when
+// skip_private_ranges is set) or one of the configured skip_cidrs.
+func (gi2 *GeoIp2Decoder) skipLookup(ip net.IP) bool {
+        if gi2.SkipPrivateRanges &&
+        (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()){
+                return true
+        }
+        for _, network := range gi2.skipCIDRs {
+                if network.Contains(ip) {
+                        return true
                 }
         }
+        return false
+}
 
+// countryAllowed reports whether enrichment should proceed for a record
+// with the given country ISO code, per the configured only_countries and
+// skip_countries lists. An empty code (no country data) is always allowed.
+func (gi2 *GeoIp2Decoder) countryAllowed(countryCode string) bool {
+        if countryCode == "" {
+                return true
+        }
+        if gi2.onlyCountries != nil && !gi2.onlyCountries[countryCode] {
+                return false
+        }
+        if gi2.skipCountries != nil && gi2.skipCountries[countryCode] {
+                return false
+        }
+        return true
+}
+
+// lookupParallel fans the anon/connection-type/ISP/ASN/custom lookups for
+// ip out across gi2.workerSem, bounded by the "workers" config setting, so
+// a single pack's mmdb hits run concurrently instead of one at a time on
+// the decoder goroutine. The city DB is looked up separately by the
+// caller since its result gates whether the rest of Decode runs at all.
+func (gi2 *GeoIp2Decoder) lookupParallel(ip net.IP, anonBackend, connBackend, ispBackend, asnBackend, customBackend GeoBackend) (anonRec, connRec, ispRec, asnRec, customRec *Record) {
+        var wg sync.WaitGroup
+
+        run := func(backend GeoBackend, dst **Record) {
+                if backend == nil {
+                        return
+                }
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        gi2.workerSem <- struct{}{}
+                        defer func() { <-gi2.workerSem }()
+
+                        if rec, err := backend.Lookup(ip); err == nil {
+                                *dst = rec
+                        }
+                }()
+        }
+
+        run(anonBackend, &anonRec)
+        run(connBackend, &connRec)
+        run(ispBackend, &ispRec)
+        run(asnBackend, &asnRec)
+        run(customBackend, &customRec)
+
+        wg.Wait()
         return
 }
 
@@ -347,38 +879,79 @@ func (gi2 *GeoIp2Decoder) Decode(pack *PipelinePack) (packs []*PipelinePack, fai
                             continue
                     }
                 }
-                if gi2.anon_db != nil {
-                        rec, err := gi2.anon_db.AnonymousIP(ip)
-                        if err == nil &&
-                        (rec.IsAnonymous || rec.IsAnonymousVPN || rec.IsHostingProvider || rec.IsPublicProxy || rec.IsTorExitNode){
-                                found = true
-                                gi2.CreateMessageFieldsAnonymousIP(rec, pack)
-                        }
+
+                if gi2.skipLookup(ip) {
+                        continue
                 }
-                if gi2.city_db != nil {
-                        rec, err := gi2.city_db.City(ip)
-                        if err == nil &&
-                        (rec.Location.Longitude != 0.0 && rec.Location.Latitude != 0.0){
+
+                gi2.dbLock.RLock()
+                anonBackend   := gi2.anonBackend
+                cityBackend   := gi2.cityBackend
+                connBackend   := gi2.connBackend
+                ispBackend    := gi2.ispBackend
+                asnBackend    := gi2.asnBackend
+                customBackend := gi2.customBackend
+
+                jsonFields := make(jsonObjectFields)
+
+                disallowed := false
+                if cityBackend != nil {
+                        rec, err := cityBackend.Lookup(ip)
+                        if err == nil && rec.City != nil && !gi2.countryAllowed(rec.City.Country.IsoCode) {
+                                disallowed = true
+                        } else if err == nil && rec.City != nil &&
+                        (rec.City.Location.Longitude != 0.0 && rec.City.Location.Latitude != 0.0){
                                 found = true
-                                gi2.CreateMessageFieldsCity(rec, pack)
+                                gi2.CreateMessageFieldsCity(rec.City, pack, jsonFields)
                         }
                 }
-                if gi2.conn_db != nil {
-                        rec, err := gi2.conn_db.ConnectionType(ip)
-                        if err == nil &&
-                        (rec.ConnectionType != ""){
-                                found = true
-                                gi2.CreateMessageFieldsConnectionType(rec, pack)
-                        }
+
+                var anonRec, connRec, ispRec, asnRec, customRec *Record
+                if !disallowed {
+                        anonRec, connRec, ispRec, asnRec, customRec = gi2.lookupParallel(ip, anonBackend, connBackend, ispBackend, asnBackend, customBackend)
                 }
-                if gi2.isp_db != nil {
-                        rec, err := gi2.isp_db.ISP(ip)
-                        if err != nil ||
-                        (rec.AutonomousSystemNumber != 0 || rec.AutonomousSystemOrganization != "" || rec.ISP != "" || rec.Organization != ""){
-                                found = true
-                                gi2.CreateMessageFieldsISP(rec, pack)
+                gi2.dbLock.RUnlock()
+
+                if disallowed {
+                        // The city DB's country is on the skip/only list for
+                        // this source field; try the next configured field
+                        // rather than abandoning the whole pack.
+                        continue
+                }
+
+                if anonRec != nil && anonRec.AnonymousIP != nil &&
+                (anonRec.AnonymousIP.IsAnonymous || anonRec.AnonymousIP.IsAnonymousVPN || anonRec.AnonymousIP.IsHostingProvider || anonRec.AnonymousIP.IsPublicProxy || anonRec.AnonymousIP.IsTorExitNode){
+                        found = true
+                        gi2.CreateMessageFieldsAnonymousIP(anonRec.AnonymousIP, pack, jsonFields)
+                }
+                if connRec != nil && connRec.ConnectionType != nil &&
+                (connRec.ConnectionType.ConnectionType != ""){
+                        found = true
+                        gi2.CreateMessageFieldsConnectionType(connRec.ConnectionType, pack, jsonFields)
+                }
+                if ispRec != nil && ispRec.ISP != nil &&
+                (ispRec.ISP.AutonomousSystemNumber != 0 || ispRec.ISP.AutonomousSystemOrganization != "" || ispRec.ISP.ISP != "" || ispRec.ISP.Organization != ""){
+                        found = true
+                        gi2.CreateMessageFieldsISP(ispRec.ISP, pack, jsonFields)
+                }
+                if asnRec != nil && asnRec.ASN != nil &&
+                (asnRec.ASN.AutonomousSystemNumber != 0 || asnRec.ASN.AutonomousSystemOrganization != ""){
+                        found = true
+                        gi2.CreateMessageFieldsASN(asnRec.ASN, asnRec.Network, pack, jsonFields)
+                }
+                if customRec != nil && len(customRec.Raw) > 0 {
+                        found = true
+                        gi2.CreateMessageFieldsRaw(customRec.Raw, pack, jsonFields)
+                }
+
+                if gi2.JSONObject && len(jsonFields) > 0 {
+                        raw, jerr := json.Marshal(jsonFields)
+                        if jerr != nil {
+                                return nil, jerr
                         }
+                        gi2.AddField(pack, gi2.TargetField, raw)
                 }
+
                 if found { break }
         }
 
@@ -405,6 +978,8 @@ func (gi2 *GeoIp2Decoder) GetData(v interface{}) interface{} {
                 return int64(d)
         case uint32:
                 return int32(d)
+        case uint16:
+                return int16(d)
         case uint:
                 return int(d)
         default:
@@ -412,13 +987,65 @@ func (gi2 *GeoIp2Decoder) GetData(v interface{}) interface{} {
         }
 }
 
+// ReportMsg satisfies Heka's reporting plugin interface, surfacing the
+// cache hit/miss counts summed over all backends, aggregate lookup latency
+// percentiles, and per-database error counts accumulated since Init.
+func (gi2 *GeoIp2Decoder) ReportMsg(msg *message.Message) error {
+        if gi2.stats == nil {
+                return nil
+        }
+
+        gi2.reportField(msg, "CacheHits", atomic.LoadInt64(&gi2.stats.cacheHits))
+        gi2.reportField(msg, "CacheMisses", atomic.LoadInt64(&gi2.stats.cacheMisses))
+        gi2.reportField(msg, "LookupNsP50", int64(gi2.stats.latency.Percentile(0.50)))
+        gi2.reportField(msg, "LookupNsP99", int64(gi2.stats.latency.Percentile(0.99)))
+
+        for _, kind := range []string{"anonymous_ip", "city", "connection_type", "isp", "asn", "custom"} {
+                gi2.reportField(msg, kind+"Errors", gi2.stats.errorCount(kind))
+        }
+
+        return nil
+}
+
+func (gi2 *GeoIp2Decoder) reportField(msg *message.Message, name string, value int64) {
+        field, err := message.NewField(name, value, "")
+        if err != nil {
+                gi2.LogError(fmt.Errorf("error adding report field '%s': %s", name, err))
+                return
+        }
+        msg.AddField(field)
+}
+
 func (gi2 *GeoIp2Decoder) LogError(err error) {
         LogError.Printf("GeoIp2Decoder: %s", err)
 }
 
+// Stop is called by Heka when the plugin is being shut down; it stops the
+// file watcher and auto-update goroutines, waits for them to actually
+// exit (so an in-flight updateEdition/reopenDatabase can't swap in a new
+// backend after we've closed everything below) and closes any open
+// readers.
+func (gi2 *GeoIp2Decoder) Stop() {
+        if gi2.stopChan != nil {
+                close(gi2.stopChan)
+        }
+        if gi2.watcher != nil {
+                gi2.watcher.Close()
+        }
+        gi2.bgWg.Wait()
+
+        gi2.dbLock.Lock()
+        defer gi2.dbLock.Unlock()
+
+        for _, backend := range []GeoBackend{gi2.anonBackend, gi2.cityBackend, gi2.connBackend, gi2.ispBackend, gi2.asnBackend, gi2.customBackend} {
+                if backend != nil {
+                        backend.Close()
+                }
+        }
+}
+
 func init() {
         RegisterPlugin("GeoIp2Decoder", func() interface{} {
                 return new(GeoIp2Decoder)
         })
 }
-
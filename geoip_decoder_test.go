@@ -0,0 +1,485 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Michael Gibson (michael.gibson79@gmail.com)
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package geoip2
+
+import (
+        "bytes"
+        "compress/gzip"
+        "crypto/md5"
+        "encoding/hex"
+        "encoding/json"
+        "github.com/oschwald/geoip2-golang"
+        "github.com/mozilla-services/heka/message"
+        . "github.com/mozilla-services/heka/pipeline"
+        "io/ioutil"
+        "net"
+        "net/http"
+        "net/http/httptest"
+        "os"
+        "testing"
+)
+
+// newTestPack builds a minimal PipelinePack carrying a single source
+// address field, the way a real Heka decoder would receive one.
+func newTestPack(field, ip string) *PipelinePack {
+        msg := new(message.Message)
+        addrField, _ := message.NewField(field, ip, "")
+        msg.AddField(addrField)
+        return &PipelinePack{Message: msg}
+}
+
+// newTestDecoder builds a GeoIp2Decoder wired directly to the given
+// backends, bypassing Init/openDatabases (which need real mmdb files on
+// disk) so Decode's concurrent fan-out and dbLock usage can be exercised
+// against memoryBackend fixtures instead. The backends are used as given,
+// without a cachingBackend in front of them.
+func newTestDecoder(sourceFields []string, cityBackend, asnBackend GeoBackend) *GeoIp2Decoder {
+        return &GeoIp2Decoder{
+                SourceAddrFields: sourceFields,
+                TargetField:      "geoip",
+                Language:         "en",
+                GeohashPrecision: 9,
+                cityBackend:      cityBackend,
+                asnBackend:       asnBackend,
+                workerSem:        make(chan struct{}, 2),
+                stats:            newLookupStats([]string{"city", "asn"}),
+        }
+}
+
+// TestCityDocJSON covers the values CreateMessageFieldsCity feeds through
+// encoding/json: names containing quotes/backslashes/unicode must come out
+// as valid, round-trippable JSON.
+func TestCityDocJSON(t *testing.T) {
+        cases := []struct {
+                name string
+                doc  cityDoc
+        }{
+                {
+                        name: "plain city",
+                        doc:  cityDoc{Location: [2]float64{-122.4, 37.7}, CountryCode: "US", Country: "United States", City: "San Francisco"},
+                },
+                {
+                        name: "city name with quote and backslash",
+                        doc:  cityDoc{Location: [2]float64{2.3, 48.8}, City: `Saint "Denis"\Paris`},
+                },
+                {
+                        name: "unicode city name",
+                        doc:  cityDoc{Location: [2]float64{139.6, 35.6}, City: "東京"},
+                },
+                {
+                        name: "all optional fields empty",
+                        doc:  cityDoc{Location: [2]float64{0, 0}},
+                },
+        }
+
+        for _, c := range cases {
+                t.Run(c.name, func(t *testing.T) {
+                        raw, err := json.Marshal(c.doc)
+                        if err != nil {
+                                t.Fatalf("Marshal(%+v) returned error: %s", c.doc, err)
+                        }
+
+                        var roundTripped cityDoc
+                        if err := json.Unmarshal(raw, &roundTripped); err != nil {
+                                t.Fatalf("invalid JSON produced for %+v: %s\njson: %s", c.doc, err, raw)
+                        }
+                        if roundTripped.City != c.doc.City {
+                                t.Errorf("City round-tripped to %q, want %q", roundTripped.City, c.doc.City)
+                        }
+                })
+        }
+}
+
+// TestAnonymousIPDocJSON exercises every combination of the five Anonymous*
+// flags. Before the encoding/json rewrite, any combination with IsAnonymous
+// true produced `{,"anonymous_ip": true,...}` -- invalid JSON with a
+// leading and trailing comma.
+func TestAnonymousIPDocJSON(t *testing.T) {
+        for mask := 0; mask < 32; mask++ {
+                doc := anonymousIPDoc{
+                        AnonymousIP:     mask&1 != 0,
+                        AnonymousVPN:    mask&2 != 0,
+                        HostingProvider: mask&4 != 0,
+                        PublicProxy:     mask&8 != 0,
+                        TorExitNode:     mask&16 != 0,
+                }
+
+                raw, err := json.Marshal(doc)
+                if err != nil {
+                        t.Fatalf("mask %d: Marshal(%+v) returned error: %s", mask, doc, err)
+                }
+
+                var roundTripped anonymousIPDoc
+                if err := json.Unmarshal(raw, &roundTripped); err != nil {
+                        t.Fatalf("mask %d: invalid JSON produced for %+v: %s\njson: %s", mask, doc, err, raw)
+                }
+                if roundTripped != doc {
+                        t.Errorf("mask %d: round-tripped to %+v, want %+v", mask, roundTripped, doc)
+                }
+        }
+}
+
+func TestISPDocJSON(t *testing.T) {
+        cases := []ispDoc{
+                {},
+                {ASNumber: 15169, ASName: "Google LLC", ISP: "Google", Organization: `Google "Inc."`},
+        }
+
+        for _, doc := range cases {
+                raw, err := json.Marshal(doc)
+                if err != nil {
+                        t.Fatalf("Marshal(%+v) returned error: %s", doc, err)
+                }
+                var roundTripped ispDoc
+                if err := json.Unmarshal(raw, &roundTripped); err != nil {
+                        t.Fatalf("invalid JSON produced for %+v: %s\njson: %s", doc, err, raw)
+                }
+                if roundTripped != doc {
+                        t.Errorf("round-tripped to %+v, want %+v", roundTripped, doc)
+                }
+        }
+}
+
+// TestSkipLookup covers skip_private_ranges and skip_cidrs, each on its
+// own.
+func TestSkipLookup(t *testing.T) {
+        _, blockedNet, err := net.ParseCIDR("198.51.100.0/24")
+        if err != nil {
+                t.Fatalf("ParseCIDR returned error: %s", err)
+        }
+
+        cases := []struct {
+                name              string
+                skipPrivateRanges bool
+                skipCIDRs         []*net.IPNet
+                ip                string
+                want              bool
+        }{
+                {"private range skipped when enabled", true, nil, "10.0.0.1", true},
+                {"loopback skipped when enabled", true, nil, "127.0.0.1", true},
+                {"private range kept when disabled", false, nil, "10.0.0.1", false},
+                {"public IP never skipped by private_ranges", true, nil, "203.0.113.1", false},
+                {"IP in skip_cidrs skipped", false, []*net.IPNet{blockedNet}, "198.51.100.5", true},
+                {"IP outside skip_cidrs kept", false, []*net.IPNet{blockedNet}, "203.0.113.1", false},
+        }
+
+        for _, c := range cases {
+                t.Run(c.name, func(t *testing.T) {
+                        gi2 := &GeoIp2Decoder{SkipPrivateRanges: c.skipPrivateRanges, skipCIDRs: c.skipCIDRs}
+                        if got := gi2.skipLookup(net.ParseIP(c.ip)); got != c.want {
+                                t.Errorf("skipLookup(%s) = %v, want %v", c.ip, got, c.want)
+                        }
+                })
+        }
+}
+
+// TestCountryAllowed covers only_countries and skip_countries, individually,
+// combined, and with no country data at all.
+func TestCountryAllowed(t *testing.T) {
+        cases := []struct {
+                name          string
+                onlyCountries map[string]bool
+                skipCountries map[string]bool
+                countryCode   string
+                want          bool
+        }{
+                {"no lists configured", nil, nil, "US", true},
+                {"no country data always allowed", map[string]bool{"US": true}, nil, "", true},
+                {"only_countries allows listed code", map[string]bool{"US": true}, nil, "US", true},
+                {"only_countries rejects unlisted code", map[string]bool{"US": true}, nil, "FR", false},
+                {"skip_countries rejects listed code", nil, map[string]bool{"FR": true}, "FR", false},
+                {"skip_countries allows unlisted code", nil, map[string]bool{"FR": true}, "US", true},
+                {"skip_countries wins when both configured", map[string]bool{"US": true, "FR": true}, map[string]bool{"FR": true}, "FR", false},
+        }
+
+        for _, c := range cases {
+                t.Run(c.name, func(t *testing.T) {
+                        gi2 := &GeoIp2Decoder{onlyCountries: c.onlyCountries, skipCountries: c.skipCountries}
+                        if got := gi2.countryAllowed(c.countryCode); got != c.want {
+                                t.Errorf("countryAllowed(%q) = %v, want %v", c.countryCode, got, c.want)
+                        }
+                })
+        }
+}
+
+// TestDecodeEndToEnd exercises Decode's city and ASN backends together,
+// which run through the concurrent lookupParallel fan-out, checking that
+// the geohash/EU fields and the ASN CIDR end up on the pack.
+func TestDecodeEndToEnd(t *testing.T) {
+        ip := net.ParseIP("203.0.113.7")
+        _, network, err := net.ParseCIDR("203.0.113.0/24")
+        if err != nil {
+                t.Fatalf("ParseCIDR returned error: %s", err)
+        }
+
+        city := &geoip2.City{}
+        city.Location.Latitude = 37.7
+        city.Location.Longitude = -122.4
+        city.Country.IsoCode = "US"
+        city.Country.Names = map[string]string{"en": "United States"}
+        city.City.Names = map[string]string{"en": "San Francisco"}
+
+        cityBackend := newMemoryBackend()
+        cityBackend.Set(ip, &Record{City: city})
+
+        asnBackend := newMemoryBackend()
+        asnBackend.Set(ip, &Record{
+                ASN:     &geoip2.ASN{AutonomousSystemNumber: 15169, AutonomousSystemOrganization: "Google LLC"},
+                Network: network,
+        })
+
+        gi2 := newTestDecoder([]string{"remote_addr"}, cityBackend, asnBackend)
+        pack := newTestPack("remote_addr", ip.String())
+
+        packs, err := gi2.Decode(pack)
+        if err != nil {
+                t.Fatalf("Decode returned error: %s", err)
+        }
+        if len(packs) != 1 || packs[0] != pack {
+                t.Fatalf("Decode returned %+v, want the original pack", packs)
+        }
+
+        cases := []struct {
+                field string
+                want  interface{}
+        }{
+                {"geoip_city", "San Francisco"},
+                {"geoip_country_code", "US"},
+                {"geoip_geohash", "9q8yqxp43"},
+                {"geoip_country_is_eu", false},
+                {"asn_number", int64(15169)},
+                {"asn_organization", "Google LLC"},
+                {"source_range", "203.0.113.0/24"},
+        }
+        for _, c := range cases {
+                got, ok := pack.Message.GetFieldValue(c.field)
+                if !ok {
+                        t.Errorf("field %q missing from pack", c.field)
+                        continue
+                }
+                if got != c.want {
+                        t.Errorf("field %q = %v, want %v", c.field, got, c.want)
+                }
+        }
+}
+
+// TestDecodeCountryDisallowedTriesNextField checks that a disallowed
+// country on the first source_addr_fields entry doesn't abort the whole
+// pack: Decode should continue on to the next configured field.
+func TestDecodeCountryDisallowedTriesNextField(t *testing.T) {
+        blockedIP := net.ParseIP("203.0.113.7")
+        allowedIP := net.ParseIP("198.51.100.9")
+
+        blockedCity := &geoip2.City{}
+        blockedCity.Location.Latitude, blockedCity.Location.Longitude = 1, 1
+        blockedCity.Country.IsoCode = "FR"
+
+        allowedCity := &geoip2.City{}
+        allowedCity.Location.Latitude, allowedCity.Location.Longitude = 2, 2
+        allowedCity.Country.IsoCode = "US"
+
+        cityBackend := newMemoryBackend()
+        cityBackend.Set(blockedIP, &Record{City: blockedCity})
+        cityBackend.Set(allowedIP, &Record{City: allowedCity})
+
+        gi2 := newTestDecoder([]string{"blocked_addr", "remote_addr"}, cityBackend, nil)
+        gi2.skipCountries = map[string]bool{"FR": true}
+
+        msg := new(message.Message)
+        blockedField, _ := message.NewField("blocked_addr", blockedIP.String(), "")
+        allowedField, _ := message.NewField("remote_addr", allowedIP.String(), "")
+        msg.AddField(blockedField)
+        msg.AddField(allowedField)
+        pack := &PipelinePack{Message: msg}
+
+        if _, err := gi2.Decode(pack); err != nil {
+                t.Fatalf("Decode returned error: %s", err)
+        }
+
+        got, ok := pack.Message.GetFieldValue("geoip_country_code")
+        if !ok {
+                t.Fatal("geoip_country_code missing from pack; disallowed first field should not have stopped processing")
+        }
+        if got != "US" {
+                t.Errorf("geoip_country_code = %v, want US (from the second source field)", got)
+        }
+}
+
+// gzipBytes is a test helper that gzips content the way MaxMind's update
+// endpoint serves its .mmdb payloads.
+func gzipBytes(t *testing.T, content []byte) []byte {
+        t.Helper()
+        var buf bytes.Buffer
+        gw := gzip.NewWriter(&buf)
+        if _, err := gw.Write(content); err != nil {
+                t.Fatalf("gzip.Write returned error: %s", err)
+        }
+        if err := gw.Close(); err != nil {
+                t.Fatalf("gzip.Close returned error: %s", err)
+        }
+        return buf.Bytes()
+}
+
+// withUpdateServer points updateBaseURL at an httptest.Server for the
+// duration of the test and restores it afterward.
+func withUpdateServer(t *testing.T, handler http.HandlerFunc) {
+        t.Helper()
+        server := httptest.NewServer(handler)
+        t.Cleanup(server.Close)
+
+        original := updateBaseURL
+        updateBaseURL = server.URL
+        t.Cleanup(func() { updateBaseURL = original })
+}
+
+// TestUpdateEditionAppliesValidDatabase checks the happy path: a gzipped
+// body whose X-Database-MD5 header matches its decompressed content is
+// written to DataDir/<edition>.mmdb.
+func TestUpdateEditionAppliesValidDatabase(t *testing.T) {
+        content := []byte("fake mmdb contents")
+        sum := md5.Sum(content)
+
+        withUpdateServer(t, func(w http.ResponseWriter, r *http.Request) {
+                w.Header().Set("X-Database-MD5", hex.EncodeToString(sum[:]))
+                w.Write(gzipBytes(t, content))
+        })
+
+        dataDir, err := ioutil.TempDir("", "geoip2-update")
+        if err != nil {
+                t.Fatalf("TempDir returned error: %s", err)
+        }
+        defer os.RemoveAll(dataDir)
+
+        gi2 := &GeoIp2Decoder{Config: &GeoIp2DecoderConfig{DataDir: dataDir}, stopChan: make(chan struct{})}
+        if err := gi2.updateEdition("GeoLite2-City"); err != nil {
+                t.Fatalf("updateEdition returned error: %s", err)
+        }
+
+        got, err := ioutil.ReadFile(dataDir + "/GeoLite2-City.mmdb")
+        if err != nil {
+                t.Fatalf("expected mmdb file was not written: %s", err)
+        }
+        if !bytes.Equal(got, content) {
+                t.Errorf("written database = %q, want %q", got, content)
+        }
+}
+
+// TestUpdateEditionRejectsChecksumMismatch checks that a response whose
+// X-Database-MD5 doesn't match its body is rejected before anything is
+// written to DataDir.
+func TestUpdateEditionRejectsChecksumMismatch(t *testing.T) {
+        content := []byte("tampered mmdb contents")
+
+        withUpdateServer(t, func(w http.ResponseWriter, r *http.Request) {
+                w.Header().Set("X-Database-MD5", "0000000000000000000000000000000")
+                w.Write(gzipBytes(t, content))
+        })
+
+        dataDir, err := ioutil.TempDir("", "geoip2-update")
+        if err != nil {
+                t.Fatalf("TempDir returned error: %s", err)
+        }
+        defer os.RemoveAll(dataDir)
+
+        gi2 := &GeoIp2Decoder{Config: &GeoIp2DecoderConfig{DataDir: dataDir}, stopChan: make(chan struct{})}
+        if err := gi2.updateEdition("GeoLite2-City"); err == nil {
+                t.Fatal("updateEdition returned nil error for a checksum mismatch")
+        }
+
+        if _, err := os.Stat(dataDir + "/GeoLite2-City.mmdb"); !os.IsNotExist(err) {
+                t.Errorf("mmdb file was written despite the checksum mismatch")
+        }
+}
+
+// TestUpdateEditionRejectsMissingChecksumHeader checks that a response
+// with no X-Database-MD5 header at all is rejected rather than trusted.
+func TestUpdateEditionRejectsMissingChecksumHeader(t *testing.T) {
+        withUpdateServer(t, func(w http.ResponseWriter, r *http.Request) {
+                w.Write(gzipBytes(t, []byte("whatever")))
+        })
+
+        dataDir, err := ioutil.TempDir("", "geoip2-update")
+        if err != nil {
+                t.Fatalf("TempDir returned error: %s", err)
+        }
+        defer os.RemoveAll(dataDir)
+
+        gi2 := &GeoIp2Decoder{Config: &GeoIp2DecoderConfig{DataDir: dataDir}, stopChan: make(chan struct{})}
+        if err := gi2.updateEdition("GeoLite2-City"); err == nil {
+                t.Fatal("updateEdition returned nil error for a response missing X-Database-MD5")
+        }
+}
+
+// TestDecodeJSONObjectMergesBackends checks that when more than one
+// backend matches an address in raw_json_object mode, Decode emits a
+// single gi2.TargetField holding both docs merged by kind, rather than
+// two separate fields that both happen to be named "geoip" (in which
+// case GetFieldValue would only ever see whichever one was added first,
+// and it would be missing the other backend's data).
+func TestDecodeJSONObjectMergesBackends(t *testing.T) {
+        ip := net.ParseIP("203.0.113.7")
+        _, network, err := net.ParseCIDR("203.0.113.0/24")
+        if err != nil {
+                t.Fatalf("ParseCIDR returned error: %s", err)
+        }
+
+        city := &geoip2.City{}
+        city.Location.Latitude = 37.7
+        city.Location.Longitude = -122.4
+        city.Country.IsoCode = "US"
+
+        cityBackend := newMemoryBackend()
+        cityBackend.Set(ip, &Record{City: city})
+
+        asnBackend := newMemoryBackend()
+        asnBackend.Set(ip, &Record{
+                ASN:     &geoip2.ASN{AutonomousSystemNumber: 15169, AutonomousSystemOrganization: "Google LLC"},
+                Network: network,
+        })
+
+        gi2 := newTestDecoder([]string{"remote_addr"}, cityBackend, asnBackend)
+        gi2.JSONObject = true
+        pack := newTestPack("remote_addr", ip.String())
+
+        if _, err := gi2.Decode(pack); err != nil {
+                t.Fatalf("Decode returned error: %s", err)
+        }
+
+        value, ok := pack.Message.GetFieldValue(gi2.TargetField)
+        if !ok {
+                t.Fatalf("field %q missing from pack", gi2.TargetField)
+        }
+
+        var merged jsonObjectFields
+        if err := json.Unmarshal(value.([]byte), &merged); err != nil {
+                t.Fatalf("field %q is not valid JSON: %s\nvalue: %s", gi2.TargetField, err, value)
+        }
+        if _, ok := merged["city"]; !ok {
+                t.Errorf("merged object missing \"city\" key: %+v", merged)
+        }
+        if _, ok := merged["asn"]; !ok {
+                t.Errorf("merged object missing \"asn\" key: %+v", merged)
+        }
+}
+
+// TestUpdateHTTPClientHasTimeout checks that updateEdition can't block
+// forever on a hung MaxMind endpoint, which would in turn block Stop's
+// bgWg.Wait on shutdown.
+func TestUpdateHTTPClientHasTimeout(t *testing.T) {
+        if updateHTTPClient.Timeout <= 0 {
+                t.Error("updateHTTPClient has no timeout set")
+        }
+}
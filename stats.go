@@ -0,0 +1,115 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Michael Gibson (michael.gibson79@gmail.com)
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package geoip2
+
+import (
+        "sort"
+        "sync"
+        "sync/atomic"
+        "time"
+)
+
+// latencyHistogram keeps a bounded ring buffer of recent lookup latencies,
+// good enough to report approximate p50/p99 without the bookkeeping of a
+// real streaming quantile sketch.
+type latencyHistogram struct {
+        mu      sync.Mutex
+        samples []time.Duration
+        next    int
+        filled  bool
+}
+
+func newLatencyHistogram(capacity int) *latencyHistogram {
+        return &latencyHistogram{samples: make([]time.Duration, capacity)}
+}
+
+func (h *latencyHistogram) Record(d time.Duration) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+
+        h.samples[h.next] = d
+        h.next++
+        if h.next == len(h.samples) {
+                h.next = 0
+                h.filled = true
+        }
+}
+
+// Percentile returns the p-th percentile (0..1) of the samples currently
+// in the buffer, or zero if none have been recorded yet.
+func (h *latencyHistogram) Percentile(p float64) time.Duration {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+
+        n := h.next
+        if h.filled {
+                n = len(h.samples)
+        }
+        if n == 0 {
+                return 0
+        }
+
+        sorted := make([]time.Duration, n)
+        copy(sorted, h.samples[:n])
+        sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+        idx := int(p * float64(n-1))
+        return sorted[idx]
+}
+
+// lookupStats aggregates the counters a cachingBackend feeds on every
+// Lookup call, so GeoIp2Decoder.ReportMsg can expose them through Heka's
+// plugin reporting interface without each backend knowing about Heka.
+type lookupStats struct {
+        cacheHits   int64
+        cacheMisses int64
+        latency     *latencyHistogram
+        dbErrors    map[string]*int64
+}
+
+func newLookupStats(kinds []string) *lookupStats {
+        s := &lookupStats{
+                latency:  newLatencyHistogram(1024),
+                dbErrors: make(map[string]*int64, len(kinds)),
+        }
+        for _, kind := range kinds {
+                s.dbErrors[kind] = new(int64)
+        }
+        return s
+}
+
+func (s *lookupStats) recordHit() {
+        atomic.AddInt64(&s.cacheHits, 1)
+}
+
+func (s *lookupStats) recordMiss() {
+        atomic.AddInt64(&s.cacheMisses, 1)
+}
+
+// recordError is a no-op for a kind that wasn't registered with
+// newLookupStats, so callers don't need to guard every call site.
+func (s *lookupStats) recordError(kind string) {
+        if counter, ok := s.dbErrors[kind]; ok {
+                atomic.AddInt64(counter, 1)
+        }
+}
+
+func (s *lookupStats) errorCount(kind string) int64 {
+        if counter, ok := s.dbErrors[kind]; ok {
+                return atomic.LoadInt64(counter)
+        }
+        return 0
+}